@@ -19,15 +19,41 @@ set -e
 help()
 {
    printf "\n"
-   printf "Usage: $0 -t tag\n"
+   printf "Usage: $0 -t tag [-b base] [-g lint|tidy] [-s regex] [-l target] [-c target] [-n] [-d]\n"
    printf "\t-t Unreleased tag. Update all go.mod with this tag.\n"
+   printf "\t-b Base ref to create the release branch from (default: main).\n"
+   printf "\t-g Tool used to update go.sum: 'lint' runs the lint target (default),\n"
+   printf "\t   'tidy' runs go mod tidy in each module directly.\n"
+   printf "\t-s Extended regex of module directories to skip in '-g tidy' and\n"
+   printf "\t   the go.sum verification.\n"
+   printf "\t-l Make target used to lint (default: lint).\n"
+   printf "\t-c Make target run before committing (default: ci).\n"
+   printf "\t-n Skip git hooks when committing (git commit --no-verify).\n"
+   printf "\t-d Dry run. Print the diff of each file that would change and exit\n"
+   printf "\t   without creating a branch, writing files or committing.\n"
    exit 1 # Exit script after printing help
 }
 
-while getopts "t:" opt
+TAG=""
+BASE_REF="main"
+GOSUM_TOOL="lint"
+SKIP_CHECKS=""
+LINT_TARGET="lint"
+CI_TARGET="ci"
+COMMIT_ARGS=()
+DRY_RUN=""
+
+while getopts "t:b:g:s:l:c:nd" opt
 do
    case "$opt" in
       t ) TAG="$OPTARG" ;;
+      b ) BASE_REF="$OPTARG" ;;
+      g ) GOSUM_TOOL="$OPTARG" ;;
+      s ) SKIP_CHECKS="$OPTARG" ;;
+      l ) LINT_TARGET="$OPTARG" ;;
+      c ) CI_TARGET="$OPTARG" ;;
+      n ) COMMIT_ARGS+=("--no-verify") ;;
+      d ) DRY_RUN=1 ;;
       ? ) help ;; # Print help
    esac
 done
@@ -39,6 +65,11 @@ then
    help
 fi
 
+if [[ "${GOSUM_TOOL}" != "lint" && "${GOSUM_TOOL}" != "tidy" ]]; then
+   printf "Invalid go.sum tool: ${GOSUM_TOOL}\n";
+   help
+fi
+
 # Validate semver
 SEMVER_REGEX="^v(0|[1-9][0-9]*)\\.(0|[1-9][0-9]*)\\.(0|[1-9][0-9]*)(\\-[0-9A-Za-z-]+(\\.[0-9A-Za-z-]+)*)?(\\+[0-9A-Za-z-]+(\\.[0-9A-Za-z-]+)*)?$"
 if [[ "${TAG}" =~ ${SEMVER_REGEX} ]]; then
@@ -54,13 +85,22 @@ if [[ ${TAG_FOUND} = ${TAG} ]] ; then
         exit -1
 fi
 
-# Get version for version.go
-OTEL_VERSION=$(echo "${TAG}" | grep -o '^v[0-9]\+\.[0-9]\+\.[0-9]\+')
-# Strip leading v
-OTEL_VERSION="${OTEL_VERSION#v}"
+# Get version for version.go, keeping any prerelease or build suffix
+OTEL_VERSION="${TAG#v}"
 
 cd $(dirname $0)
 
+MAKE_TARGETS=("${CI_TARGET}")
+if [[ "${GOSUM_TOOL}" = "lint" ]]; then
+   MAKE_TARGETS+=("${LINT_TARGET}")
+fi
+for target in "${MAKE_TARGETS[@]}"; do
+   if ! make -n "${target}" >/dev/null 2>&1; then
+      printf "Make target ${target} does not exist\n"
+      exit -1
+   fi
+done
+
 if ! git diff --quiet; then \
 	printf "Working tree is not clean, can't proceed with the release process\n"
 	git status
@@ -68,28 +108,94 @@ if ! git diff --quiet; then \
 	exit 1
 fi
 
-# Update version.go
-cp ./version.go ./version.go.bak
-sed "s/\(return \"\)[0-9]*\.[0-9]*\.[0-9]*\"/\1${OTEL_VERSION}\"/" ./version.go.bak >./version.go
-rm -f ./version.go.bak
+BASE_SHA=$(git rev-parse --quiet --verify "${BASE_REF}^{commit}") || {
+	printf "Invalid base ref ${BASE_REF}\n"
+	exit 1
+}
 
-# Update go.mod
-git checkout -b pre_release_${TAG} main
+# Warn if the release branch would be based on stale history
+if UPSTREAM_SHA=$(git rev-parse --quiet --verify "${BASE_REF}@{upstream}" 2>/dev/null) \
+	&& [[ "$(git merge-base "${BASE_SHA}" "${UPSTREAM_SHA}")" != "${UPSTREAM_SHA}" ]]; then
+	printf "Warning: ${BASE_REF} is behind its upstream, the release branch may be based on stale history\n"
+fi
+
+# Rewrite the version.go content read from stdin
+new_version_go()
+{
+	# Match the whole returned literal, including any prerelease or build suffix.
+	sed "s/\(return \"\)[^\"]*\"/\1${OTEL_VERSION}\"/"
+}
+
+# Rewrite the go.mod content read from stdin
+new_go_mod()
+{
+	# Match the whole version, including any prerelease or build suffix.
+	sed -E "s/opentelemetry.io\/otel([^ ]*) v[0-9]+\.[0-9]+\.[0-9]+[^[:space:]]*/opentelemetry.io\/otel\1 ${TAG}/"
+}
+
+if [[ -n "${DRY_RUN}" ]]; then
+	# Diff against the base ref the release branch would be created from
+	PACKAGE_DIRS=$(git ls-tree -r --name-only "${BASE_SHA}" | sed -n 's/\/go\.mod$//p' | egrep -v 'tools' | sort)
+	git show "${BASE_SHA}:version.go" | new_version_go \
+		| diff -u --label a/version.go --label b/version.go <(git show "${BASE_SHA}:version.go") - || true
+	for dir in $PACKAGE_DIRS; do
+		git show "${BASE_SHA}:${dir}/go.mod" | new_go_mod \
+			| diff -u --label "a/${dir}/go.mod" --label "b/${dir}/go.mod" <(git show "${BASE_SHA}:${dir}/go.mod") - || true
+	done
+	exit 0
+fi
+
+git checkout -b pre_release_${TAG} "${BASE_SHA}"
 PACKAGE_DIRS=$(find . -mindepth 2 -type f -name 'go.mod' -exec dirname {} \; | egrep -v 'tools' | sed 's/^\.\///' | sort)
 
+# Update version.go
+new_version_go <./version.go >./version.go.new
+mv ./version.go.new ./version.go
+
+# Update go.mod
 for dir in $PACKAGE_DIRS; do
-	cp "${dir}/go.mod" "${dir}/go.mod.bak"
-	sed "s/opentelemetry.io\/otel\([^ ]*\) v[0-9]*\.[0-9]*\.[0-9]/opentelemetry.io\/otel\1 ${TAG}/" "${dir}/go.mod.bak" >"${dir}/go.mod"
-	rm -f "${dir}/go.mod.bak"
+	new_go_mod <"${dir}/go.mod" >"${dir}/go.mod.new"
+	mv "${dir}/go.mod.new" "${dir}/go.mod"
 done
 
-# Run lint to update go.sum
-make lint
+# Update go.sum
+if [[ "${GOSUM_TOOL}" = "tidy" ]]; then
+	for dir in . $PACKAGE_DIRS; do
+		if [[ -n "${SKIP_CHECKS}" ]] && echo "${dir}" | egrep -q -e "${SKIP_CHECKS}"; then
+			printf "skipping go mod tidy in ${dir}\n"
+			continue
+		fi
+		printf "go mod tidy in ${dir}\n"
+		(cd "${dir}" && go mod tidy)
+	done
+else
+	make "${LINT_TARGET}"
+fi
+
+# Verify go.sum is consistent with the rewritten go.mod
+GOSUM_STALE=""
+for dir in . $PACKAGE_DIRS; do
+	if [[ -n "${SKIP_CHECKS}" ]] && echo "${dir}" | egrep -q -e "${SKIP_CHECKS}"; then
+		printf "skipping go.sum check in ${dir}\n"
+		continue
+	fi
+	# go.sum is stale if go mod tidy still has to change it.
+	if ! (cd "${dir}" && \
+		{ cat go.sum 2>/dev/null >go.sum.bak || true; } && \
+		go mod tidy && cat go.sum 2>/dev/null | cmp -s - go.sum.bak; \
+		status=$?; rm -f go.sum.bak; exit ${status}); then
+		GOSUM_STALE="${GOSUM_STALE} ${dir}"
+	fi
+done
+if [[ -n "${GOSUM_STALE}" ]]; then
+	printf "go.sum does not match go.mod in:${GOSUM_STALE}\n"
+	exit 1
+fi
 
 # Add changes and commit.
 git add .
-make ci
-git commit -m "Prepare for releasing $TAG"
+make "${CI_TARGET}"
+git commit "${COMMIT_ARGS[@]}" -m "Prepare for releasing $TAG"
 
-printf "Now run following to verify the changes.\ngit diff main\n"
+printf "Now run following to verify the changes.\ngit diff ${BASE_REF}\n"
 printf "\nThen push the changes to upstream\n"
@@ -19,6 +19,9 @@ readonly PROGDIR=$(readlink -m "$(dirname "$0")")
 
 readonly EXCLUDE_PACKAGES="internal/tools"
 readonly SEMVER_REGEX="v(0|[1-9][0-9]*)\\.(0|[1-9][0-9]*)\\.(0|[1-9][0-9]*)(\\-[0-9A-Za-z-]+(\\.[0-9A-Za-z-]+)*)?(\\+[0-9A-Za-z-]+(\\.[0-9A-Za-z-]+)*)?"
+readonly DEFAULT_TAG_MESSAGE="Version {{.Tag}}"
+readonly DEFAULT_COMMIT_PATTERN="^Prepare for releasing"
+readonly DATE_REGEX="^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2}(Z|[+-][0-9]{2}:[0-9]{2})?$"
 
 usage() {
     cat <<- EOF
@@ -28,38 +31,136 @@ Creates git tag for all Go packages in project.
 
 OPTIONS:
   -h --help        Show this help.
+  -m --tag-message TEMPLATE
+                   Annotation message template for each tag (default:
+                   "$DEFAULT_TAG_MESSAGE"). {{.Tag}} is replaced with the
+                   full tag name and {{.Version}} with SEMVER_TAG.
+  -d --tag-date DATE
+                   Tagger date to record in each tag, as an ISO 8601
+                   date-time (YYYY-MM-DDThh:mm:ss[Z|+hh:mm]).
+                   Defaults to the current time.
+  -g --github-output
+                   Also write the version and the newline-separated list
+                   of created tags to the file named by GITHUB_OUTPUT.
+  -r --ref REF     Ref the commit must be reachable from (default: HEAD).
+  -b --build-check Run "go build ./..." in every module of COMMIT_HASH,
+                   checked out in a temporary worktree, and abort tagging
+                   if any module fails to build.
+  -s --skip-checks REGEX
+                   Extended regular expression of module directories to
+                   skip in the build check. Skipped modules are still
+                   tagged.
+  -p --commit-pattern REGEX
+                   Extended regular expression the subject of the tagged
+                   commit is expected to match; a warning is printed if it
+                   does not (default: "$DEFAULT_COMMIT_PATTERN"). An empty
+                   pattern disables the check.
+  -e --skip-existing
+                   Skip modules whose tag already exists at COMMIT_HASH and
+                   only create the missing tags. A tag that exists at a
+                   different commit is still an error.
+  -n --preview     Print the name, target commit, tagger and message of
+                   each tag that would be created without creating it.
+  -v --verify      Check each tag points at COMMIT_HASH right after it is
+                   created, deleting all tags created by this run if any
+                   check fails.
+  -c --require-clean
+                   Fail instead of warning when the working tree has
+                   uncommitted changes.
 
 ARGUMENTS:
   SEMVER_TAG       Semantic version to tag with.
-  COMMIT_HASH      Git commit hash to tag.
+  COMMIT_HASH      Git commit hash to tag. A branch name may be given to
+                   tag the commit at its tip.
 EOF
 }
 
 cmdline() {
     local arg commit
+    local args=""
+
+    # Option defaults, set explicitly so values from the environment are ignored.
+    TAG_MESSAGE="$DEFAULT_TAG_MESSAGE"
+    TAG_DATE=""
+    WRITE_GITHUB_OUTPUT=""
+    REF="HEAD"
+    BUILD_CHECK=""
+    SKIP_CHECKS=""
+    COMMIT_PATTERN="$DEFAULT_COMMIT_PATTERN"
+    REQUIRE_CLEAN=""
+    SKIP_EXISTING=""
+    PREVIEW=""
+    VERIFY=""
 
     for arg
     do
-        local delim=""
         case "$arg" in
             # Translate long form options to short form.
             --help)           args="${args}-h ";;
-            # Pass through for everything else.
-            *) [[ "${arg:0:1}" == "-" ]] || delim="\""
-                args="${args}${delim}${arg}${delim} ";;
+            --tag-message)    args="${args}-m ";;
+            --tag-date)       args="${args}-d ";;
+            --github-output)  args="${args}-g ";;
+            --ref)            args="${args}-r ";;
+            --build-check)    args="${args}-b ";;
+            --skip-checks)    args="${args}-s ";;
+            --commit-pattern) args="${args}-p ";;
+            --require-clean)  args="${args}-c ";;
+            --skip-existing)  args="${args}-e ";;
+            --preview)        args="${args}-n ";;
+            --verify)         args="${args}-v ";;
+            # Pass through for everything else, escaped for the eval below.
+            *) args="${args}$( printf "%q" "$arg" ) ";;
         esac
     done
 
     # Reset and process short form options.
     eval set -- "$args"
 
-    while getopts "h" OPTION
+    while getopts "hm:d:gr:bs:p:cenv" OPTION
     do
          case $OPTION in
          h)
              usage
              exit 0
              ;;
+         m)
+             TAG_MESSAGE="$OPTARG"
+             ;;
+         d)
+             TAG_DATE="$OPTARG"
+             ;;
+         g)
+             if [ -z "$GITHUB_OUTPUT" ]
+             then
+                 echo "GITHUB_OUTPUT is not set"
+                 exit 1
+             fi
+             WRITE_GITHUB_OUTPUT=1
+             ;;
+         r)
+             REF="$OPTARG"
+             ;;
+         b)
+             BUILD_CHECK=1
+             ;;
+         s)
+             SKIP_CHECKS="$OPTARG"
+             ;;
+         p)
+             COMMIT_PATTERN="$OPTARG"
+             ;;
+         c)
+             REQUIRE_CLEAN=1
+             ;;
+         e)
+             SKIP_EXISTING=1
+             ;;
+         n)
+             PREVIEW=1
+             ;;
+         v)
+             VERIFY=1
+             ;;
          *)
              echo "unknown option: $OPTION"
              usage
@@ -68,6 +169,17 @@ cmdline() {
         esac
     done
 
+    readonly TAG_MESSAGE TAG_DATE WRITE_GITHUB_OUTPUT REF BUILD_CHECK SKIP_CHECKS \
+        COMMIT_PATTERN REQUIRE_CLEAN SKIP_EXISTING PREVIEW VERIFY
+    if [ -n "$TAG_DATE" ]
+    then
+        if [[ ! "$TAG_DATE" =~ $DATE_REGEX ]] || ! date -d "$TAG_DATE" >/dev/null 2>&1
+        then
+            printf "invalid tag date: %s\n" "$TAG_DATE"
+            exit 2
+        fi
+    fi
+
     # Positional arguments.
     shift $((OPTIND-1))
     readonly TAG="$1"
@@ -82,7 +194,7 @@ cmdline() {
         printf "invalid semantic version: %s\n" "$TAG"
         exit 2
     fi
-    if [[ "$( git tag --list "$TAG" )" ]]
+    if [ -z "$SKIP_EXISTING" ] && [[ "$( git tag --list "$TAG" )" ]]
     then
         printf "tag already exists: %s\n" "$TAG"
         exit 2
@@ -96,6 +208,13 @@ cmdline() {
         usage
         exit 1
     fi
+    shift
+    if [ $# -gt 0 ]
+    then
+        printf "unexpected argument: %s\n" "$1"
+        usage
+        exit 1
+    fi
     # Verify rev is for a commit and unify hashes into a complete SHA1.
     readonly SHA="$( git rev-parse --quiet --verify "${commit}^{commit}" )"
     if [ -z "$SHA" ]
@@ -103,13 +222,56 @@ cmdline() {
         printf "invalid commit hash: %s\n" "$commit"
         exit 2
     fi
-    if [ "$( git merge-base "$SHA" HEAD )" != "$SHA" ]
+    if [ -z "$( git rev-parse --quiet --verify "${REF}^{commit}" )" ]
+    then
+        printf "invalid ref: %s\n" "$REF"
+        exit 2
+    fi
+    if [ "$( git merge-base "$SHA" "$REF" )" != "$SHA" ]
     then
-        printf "commit '%s' not found on this branch\n" "$commit"
+        printf "commit '%s' not reachable from '%s'\n" "$commit" "$REF"
+        exit 2
+    fi
+
+    if [ -n "$COMMIT_PATTERN" ]
+    then
+        local subject
+        subject="$( git log -1 --format=%s "$SHA" )"
+        if ! grep -q -E -e "$COMMIT_PATTERN" <<< "$subject"
+        then
+            printf "warning: commit '%s' subject does not match '%s': %s\n" \
+                "$commit" "$COMMIT_PATTERN" "$subject"
+        fi
+    fi
+
+    if [ -n "$( git status --porcelain --untracked-files=no )" ]
+    then
+        if [ -n "$REQUIRE_CLEAN" ]
+        then
+            echo "working tree is not clean"
+            git status --short --untracked-files=no
+            exit 2
+        fi
+        echo "warning: working tree is not clean, check you are on the intended state"
+    fi
+
+    # Validate the message template before any tag is created.
+    if [[ "$( tag_message "$TAG" )" == *"{{"* ]]
+    then
+        printf "invalid tag message template: %s\n" "$TAG_MESSAGE"
         exit 2
     fi
 }
 
+tag_message() {
+    local tag="$1"
+    local msg="$TAG_MESSAGE"
+
+    msg="${msg//"{{.Tag}}"/$tag}"
+    msg="${msg//"{{.Version}}"/$TAG}"
+    printf "%s" "$msg"
+}
+
 package_dirs() {
     # Return a list of package directories in the form:
     #
@@ -125,11 +287,111 @@ package_dirs() {
         | sort
 }
 
+build_check() {
+    local dir worktree
+    local failed=()
+
+    # Build the commit being tagged, not the current working tree.
+    worktree="$( mktemp -d )" || return 1
+    if ! git worktree add --detach --quiet "$worktree" "$SHA"
+    then
+        rmdir "$worktree"
+        return 1
+    fi
+    # Remove the worktree even if the build is interrupted.
+    trap 'git worktree remove --force "$worktree"' EXIT
+
+    for dir in . $( cd "$worktree" && package_dirs )
+    do
+        if [ -n "$SKIP_CHECKS" ] && grep -q -E -e "$SKIP_CHECKS" <<< "$dir"
+        then
+            printf "skipping build check: %s\n" "$dir"
+            continue
+        fi
+        if ! ( cd "$worktree/$dir" && go build ./... )
+        then
+            failed+=("$dir")
+        fi
+    done
+
+    git worktree remove --force "$worktree"
+    trap - EXIT
+
+    if [ "${#failed[@]}" -ne 0 ]
+    then
+        printf "build failed for module: %s\n" "${failed[@]}"
+        return 1
+    fi
+}
+
+tag_commit() {
+    local tag="$1"
+
+    git rev-parse --quiet --verify "refs/tags/${tag}^{commit}"
+}
+
+check_existing_tags() {
+    local tag existing
+    local status=0
+
+    for tag in "$TAG" $( package_dirs | sed "s|\$|/$TAG|" )
+    do
+        existing="$( tag_commit "$tag" )"
+        if [ -n "$existing" ] && [ "$existing" != "$SHA" ]
+        then
+            printf "tag %s already exists at a different commit: %s\n" "$tag" "$existing"
+            status=1
+        fi
+    done
+    return $status
+}
+
+with_tag_date() {
+    if [ -n "$TAG_DATE" ]
+    then
+        GIT_COMMITTER_DATE="$TAG_DATE" GIT_AUTHOR_DATE="$TAG_DATE" "$@"
+    else
+        "$@"
+    fi
+}
+
 git_tag() {
     local tag="$1"
     local commit="$2"
 
-    git tag -a "$tag" -s -m "Version $tag" "$commit"
+    with_tag_date git tag -a "$tag" -s -m "$( tag_message "$tag" )" "$commit"
+}
+
+verify_tag() {
+    local tag="$1"
+    local commit="$2"
+    local target
+
+    target="$( git rev-list -n 1 "$tag" 2>/dev/null )"
+    if [ "$target" != "$commit" ]
+    then
+        printf "tag %s points at '%s', expected %s\n" "$tag" "$target" "$commit"
+        return 1
+    fi
+}
+
+rollback_tags() {
+    local tag
+
+    for tag in "$@"
+    do
+        git tag -d "$tag" >/dev/null 2>&1 && printf "deleted tag: %s\n" "$tag"
+    done
+}
+
+preview_tag() {
+    local tag="$1"
+    local commit="$2"
+
+    printf "tag:     %s\n" "$tag"
+    printf "object:  %s\n" "$commit"
+    printf "tagger:  %s\n" "$( with_tag_date git var GIT_COMMITTER_IDENT )"
+    printf "message: %s\n\n" "$( tag_message "$tag" )"
 }
 
 previous_version() {
@@ -142,6 +404,22 @@ previous_version() {
         | tail -1
 }
 
+write_github_output() {
+    local delim
+
+    # Multiline values use the heredoc syntax with a random delimiter.
+    delim="EOF_$( head -c 16 /dev/urandom | od -An -tx1 | tr -d ' \n' )"
+    {
+        printf "version=%s\n" "$TAG"
+        printf "tags<<%s\n" "$delim"
+        if [ $# -gt 0 ]
+        then
+            printf "%s\n" "$@"
+        fi
+        printf "%s\n" "$delim"
+    } >> "$GITHUB_OUTPUT"
+}
+
 print_changes() {
     local tag="$1"
     local previous
@@ -156,23 +434,58 @@ print_changes() {
 }
 
 main() {
-    local dir
+    local tag
+    local tags=()
 
     cmdline "$@"
 
     cd "$PROGDIR" || exit 3
 
-    # Create tag for root package.
-    git_tag "$TAG" "$SHA"
-    printf "created tag: %s\n" "$TAG"
+    if [ -n "$BUILD_CHECK" ]
+    then
+        build_check || exit 4
+    fi
 
-    # Create tag for all sub-packages.
-    for dir in $( package_dirs )
+    if [ -n "$SKIP_EXISTING" ]
+    then
+        check_existing_tags || exit 2
+    fi
+
+    # Create tag for root package followed by all sub-packages.
+    for tag in "$TAG" $( package_dirs | sed "s|\$|/$TAG|" )
     do
-        git_tag "${dir}/$TAG" "$SHA"
-        printf "created tag: %s\n" "${dir}/$TAG"
+        if [ -n "$SKIP_EXISTING" ] && [ -n "$( tag_commit "$tag" )" ]
+        then
+            printf "skipped existing tag: %s\n" "$tag"
+            continue
+        fi
+        if [ -n "$PREVIEW" ]
+        then
+            preview_tag "$tag" "$SHA"
+            continue
+        fi
+        if ! git_tag "$tag" "$SHA"
+        then
+            printf "failed to create tag: %s\n" "$tag"
+            rollback_tags "${tags[@]}"
+            exit 5
+        fi
+        printf "created tag: %s\n" "$tag"
+        tags+=("$tag")
+        if [ -n "$VERIFY" ] && ! verify_tag "$tag" "$SHA"
+        then
+            rollback_tags "${tags[@]}"
+            exit 5
+        fi
     done
 
+    [ -z "$PREVIEW" ] || exit 0
+
+    if [ -n "$WRITE_GITHUB_OUTPUT" ]
+    then
+        write_github_output "${tags[@]}"
+    fi
+
     print_changes "$TAG"
 }
 main "$@"